@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TokenEntry describes one entry in -auth-config: a bearer token and the
+// permissions granted to it.
+type TokenEntry struct {
+	Token             string   `json:"token" yaml:"token"`
+	Subdir            string   `json:"subdir,omitempty" yaml:"subdir,omitempty"`
+	MaxUploadSize     int64    `json:"maxUploadSize,omitempty" yaml:"maxUploadSize,omitempty"`
+	RequestsPerMinute int      `json:"requestsPerMinute,omitempty" yaml:"requestsPerMinute,omitempty"`
+	AllowedMimeTypes  []string `json:"allowedMimeTypes,omitempty" yaml:"allowedMimeTypes,omitempty"`
+}
+
+type tokenConfigFile struct {
+	Tokens []TokenEntry `json:"tokens" yaml:"tokens"`
+}
+
+// tokenState is a TokenEntry plus the request-rate bucket enforcing it.
+type tokenState struct {
+	TokenEntry
+	bucket *tokenBucket
+}
+
+func (s *tokenState) allowsMimeType(mimeType string) bool {
+	if len(s.AllowedMimeTypes) == 0 {
+		return true
+	}
+	for _, allowed := range s.AllowedMimeTypes {
+		if strings.EqualFold(allowed, mimeType) {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthConfig holds the set of valid tokens loaded from -auth-config, and
+// reloads them from disk on SIGHUP so operators can add or revoke tokens
+// without restarting the server.
+type AuthConfig struct {
+	path string
+
+	mu     sync.RWMutex
+	tokens map[string]*tokenState
+}
+
+// NewAuthConfig loads the token config file at path.
+func NewAuthConfig(path string) (*AuthConfig, error) {
+	a := &AuthConfig{path: path}
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuthConfig) reload() error {
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return fmt.Errorf("auth config: %w", err)
+	}
+
+	var file tokenConfigFile
+	if strings.HasSuffix(a.path, ".yaml") || strings.HasSuffix(a.path, ".yml") {
+		err = yaml.Unmarshal(data, &file)
+	} else {
+		err = json.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return fmt.Errorf("auth config: %w", err)
+	}
+
+	tokens := make(map[string]*tokenState, len(file.Tokens))
+	for _, entry := range file.Tokens {
+		if entry.Token == "" {
+			continue
+		}
+		state := &tokenState{TokenEntry: entry}
+		if entry.RequestsPerMinute > 0 {
+			state.bucket = newTokenBucket(entry.RequestsPerMinute)
+		}
+		tokens[entry.Token] = state
+	}
+
+	a.mu.Lock()
+	a.tokens = tokens
+	a.mu.Unlock()
+	return nil
+}
+
+// watchReload reloads the token config whenever the process receives
+// SIGHUP, logging (and ignoring) any error so a bad edit doesn't bring
+// down the running server.
+func (a *AuthConfig) watchReload() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		for range sig {
+			if err := a.reload(); err != nil {
+				log.Printf("auth - reload of %s failed: %v", a.path, err)
+				continue
+			}
+			log.Printf("auth - reloaded token config from %s", a.path)
+		}
+	}()
+}
+
+func (a *AuthConfig) lookup(token string) (*tokenState, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	state, ok := a.tokens[token]
+	return state, ok
+}
+
+// tokenValue returns state's bearer token, or "" if state is nil (auth
+// disabled).
+func tokenValue(state *tokenState) string {
+	if state == nil {
+		return ""
+	}
+	return state.Token
+}
+
+// tokenFromRequest extracts the bearer token from either the standard
+// Authorization header or the X-Upload-Token header.
+func tokenFromRequest(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.Header.Get("X-Upload-Token")
+}
+
+// authenticateRequest validates the request's token and, on success,
+// returns the tokenState granting access. On failure it writes the
+// appropriate 401/403/429 JSON response itself and returns ok=false.
+func (u *UploadServer) authenticateRequest(w http.ResponseWriter, r *http.Request) (*tokenState, bool) {
+	if u.auth == nil {
+		return nil, true
+	}
+
+	token := tokenFromRequest(r)
+	if token == "" {
+		http.Error(w, `{"message":"missing bearer token"}`, http.StatusUnauthorized)
+		return nil, false
+	}
+
+	state, ok := u.auth.lookup(token)
+	if !ok {
+		http.Error(w, `{"message":"invalid token"}`, http.StatusForbidden)
+		return nil, false
+	}
+
+	if state.bucket != nil && !state.bucket.Allow() {
+		http.Error(w, `{"message":"rate limit exceeded"}`, http.StatusTooManyRequests)
+		return nil, false
+	}
+
+	return state, true
+}
+
+// scopedFileName applies a token's allowed subdirectory to fileName, so
+// that an upload is stored under the subtree the token is restricted to.
+// Under -layout=cas the content path is not scoped; the scoped name is only
+// recorded as the alias.
+func (s *tokenState) scopedFileName(fileName string) string {
+	if s == nil || s.Subdir == "" {
+		return fileName
+	}
+	return path.Join(s.Subdir, fileName)
+}
+
+// requireAuthMiddleware gates handler behind a valid token, for use with
+// -require-auth on otherwise-anonymous routes such as the upload form.
+func (u *UploadServer) requireAuthMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := u.authenticateRequest(w, r); !ok {
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// tokenBucket is a simple token-bucket rate limiter, refilled continuously
+// at requestsPerMinute/60 tokens per second up to a capacity of
+// requestsPerMinute.
+type tokenBucket struct {
+	mu           sync.Mutex
+	capacity     float64
+	tokens       float64
+	refillPerSec float64
+	last         time.Time
+}
+
+func newTokenBucket(requestsPerMinute int) *tokenBucket {
+	return &tokenBucket{
+		capacity:     float64(requestsPerMinute),
+		tokens:       float64(requestsPerMinute),
+		refillPerSec: float64(requestsPerMinute) / 60,
+		last:         time.Now(),
+	}
+}
+
+func (b *tokenBucket) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.refillPerSec
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
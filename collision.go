@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CollisionPolicy decides what name to store an upload under when Storage
+// already holds a file called fileName with content different from
+// fileHash. It returns "" to reject the upload.
+type CollisionPolicy interface {
+	Resolve(storage Storage, fileName, fileHash string) string
+}
+
+var collisionPolicies = map[string]CollisionPolicy{
+	"reject":           rejectCollisionPolicy{},
+	"hash-suffix":      hashSuffixCollisionPolicy{},
+	"overwrite":        overwriteCollisionPolicy{},
+	"timestamp-suffix": timestampSuffixCollisionPolicy{},
+	"numeric-suffix":   numericSuffixCollisionPolicy{},
+}
+
+// RegisterCollisionPolicy adds (or replaces) a named -on-conflict policy.
+func RegisterCollisionPolicy(name string, policy CollisionPolicy) {
+	collisionPolicies[name] = policy
+}
+
+// NewCollisionPolicy looks up the policy selected by -on-conflict, defaulting
+// to the pre-existing hash-suffix behavior when name is empty.
+func NewCollisionPolicy(name string) (CollisionPolicy, error) {
+	if name == "" {
+		name = "hash-suffix"
+	}
+	policy, ok := collisionPolicies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown -on-conflict policy %q", name)
+	}
+	return policy, nil
+}
+
+// rejectCollisionPolicy refuses any upload that collides with existing
+// content under a different hash.
+type rejectCollisionPolicy struct{}
+
+func (rejectCollisionPolicy) Resolve(storage Storage, fileName, fileHash string) string {
+	return ""
+}
+
+// hashSuffixCollisionPolicy is the original behavior: rename the upload by
+// appending a short hash suffix so both files are kept.
+type hashSuffixCollisionPolicy struct{}
+
+func (hashSuffixCollisionPolicy) Resolve(storage Storage, fileName, fileHash string) string {
+	extension := filepath.Ext(fileName)
+	base := strings.TrimSuffix(fileName, extension)
+	return fmt.Sprintf("%s_%s%s", base, fileHash[:7], extension)
+}
+
+// overwriteCollisionPolicy replaces the existing file in place.
+type overwriteCollisionPolicy struct{}
+
+func (overwriteCollisionPolicy) Resolve(storage Storage, fileName, fileHash string) string {
+	return fileName
+}
+
+// timestampSuffixCollisionPolicy renames the upload by appending the current
+// time so both files are kept in upload order.
+type timestampSuffixCollisionPolicy struct{}
+
+func (timestampSuffixCollisionPolicy) Resolve(storage Storage, fileName, fileHash string) string {
+	extension := filepath.Ext(fileName)
+	base := strings.TrimSuffix(fileName, extension)
+	return fmt.Sprintf("%s_%d%s", base, time.Now().UnixNano(), extension)
+}
+
+// numericSuffixCollisionPolicy renames the upload "file(1).ext", "file(2).ext"
+// and so on, picking the first name not already in use.
+type numericSuffixCollisionPolicy struct{}
+
+func (numericSuffixCollisionPolicy) Resolve(storage Storage, fileName, fileHash string) string {
+	extension := filepath.Ext(fileName)
+	base := strings.TrimSuffix(fileName, extension)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s(%d)%s", base, i, extension)
+		if !storage.Exists(candidate) {
+			return candidate
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// fakeStorage is a minimal in-memory Storage used to test CollisionPolicy
+// implementations and generateTargetName without touching disk.
+type fakeStorage struct {
+	existing map[string]bool
+	hashes   map[string]string
+}
+
+func newFakeStorage(names ...string) *fakeStorage {
+	existing := make(map[string]bool, len(names))
+	for _, n := range names {
+		existing[n] = true
+	}
+	return &fakeStorage{existing: existing, hashes: map[string]string{}}
+}
+
+func (f *fakeStorage) NewTemp() (*os.File, error)                      { return nil, nil }
+func (f *fakeStorage) Commit(*os.File, string, string) (string, error) { return "", nil }
+func (f *fakeStorage) Exists(finalName string) bool                    { return f.existing[finalName] }
+func (f *fakeStorage) Hash(finalName string) (string, error)           { return f.hashes[finalName], nil }
+
+func TestRejectCollisionPolicy(t *testing.T) {
+	got := rejectCollisionPolicy{}.Resolve(newFakeStorage("report.pdf"), "report.pdf", "deadbeef")
+	if got != "" {
+		t.Errorf("Resolve() = %q, want \"\"", got)
+	}
+}
+
+func TestHashSuffixCollisionPolicy(t *testing.T) {
+	got := hashSuffixCollisionPolicy{}.Resolve(newFakeStorage("report.pdf"), "report.pdf", "deadbeef1234")
+	want := "report_deadbee.pdf"
+	if got != want {
+		t.Errorf("Resolve() = %q, want %q", got, want)
+	}
+}
+
+func TestOverwriteCollisionPolicy(t *testing.T) {
+	got := overwriteCollisionPolicy{}.Resolve(newFakeStorage("report.pdf"), "report.pdf", "deadbeef")
+	if got != "report.pdf" {
+		t.Errorf("Resolve() = %q, want \"report.pdf\"", got)
+	}
+}
+
+func TestTimestampSuffixCollisionPolicy(t *testing.T) {
+	got := timestampSuffixCollisionPolicy{}.Resolve(newFakeStorage("report.pdf"), "report.pdf", "deadbeef")
+	if !strings.HasPrefix(got, "report_") || !strings.HasSuffix(got, ".pdf") {
+		t.Errorf("Resolve() = %q, want a report_<timestamp>.pdf name", got)
+	}
+}
+
+func TestNumericSuffixCollisionPolicy(t *testing.T) {
+	storage := newFakeStorage("report.pdf", "report(1).pdf")
+	got := numericSuffixCollisionPolicy{}.Resolve(storage, "report.pdf", "deadbeef")
+	want := "report(2).pdf"
+	if got != want {
+		t.Errorf("Resolve() = %q, want %q", got, want)
+	}
+}
+
+func TestNewCollisionPolicy(t *testing.T) {
+	if _, err := NewCollisionPolicy(""); err != nil {
+		t.Errorf("NewCollisionPolicy(\"\") returned error: %v", err)
+	}
+	if _, err := NewCollisionPolicy("unknown-policy"); err == nil {
+		t.Error("NewCollisionPolicy(\"unknown-policy\") = nil error, want error")
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/zeebo/blake3"
+)
+
+// NewHasher returns a constructor for the hash.Hash selected by -hash.
+func NewHasher(algo string) (func() hash.Hash, error) {
+	switch algo {
+	case "", "sha1":
+		return sha1.New, nil
+	case "sha256":
+		return sha256.New, nil
+	case "blake3":
+		return func() hash.Hash { return blake3.New() }, nil
+	default:
+		return nil, fmt.Errorf("unknown -hash algorithm %q", algo)
+	}
+}
+
+// hashFile hashes the content of an existing file with newHasher, without
+// holding it all in memory.
+func hashFile(filePath string, newHasher func() hash.Hash) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := newHasher()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -1,11 +1,12 @@
 package main
 
 import (
-	"crypto/sha1"
 	"embed"
 	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"net/http"
@@ -13,6 +14,8 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
 //go:embed index.html
@@ -20,16 +23,42 @@ import (
 var static embed.FS
 
 type UploadServer struct {
-	targetDir string
-	tmpDir    string
+	tmpDir  string
+	storage Storage
+
+	scanner         Scanner
+	scannerFailOpen bool
+
+	resumableTTL   time.Duration
+	resumableLocks sync.Map
+
+	collisionPolicy CollisionPolicy
+
+	hashAlgo  string
+	newHasher func() hash.Hash
+	casLayout bool
+
+	auth        *AuthConfig
+	requireAuth bool
+}
+
+type scanOutcome struct {
+	verdict *ScanVerdict
+	err     error
 }
 
-//This is where the action happens.
+// This is where the action happens.
 func (u *UploadServer) uploadHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("%s %s", r.Method, r.URL)
 	switch r.Method {
 	//GET displays the upload form.
 	case "GET":
+		if u.requireAuth {
+			if _, ok := u.authenticateRequest(w, r); !ok {
+				return
+			}
+		}
+
 		b, err := static.ReadFile("index.html")
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -39,6 +68,14 @@ func (u *UploadServer) uploadHandler(w http.ResponseWriter, r *http.Request) {
 
 	//POST takes the uploaded file(s) and saves it to disk.
 	case "POST":
+		token, ok := u.authenticateRequest(w, r)
+		if !ok {
+			return
+		}
+		if token != nil && token.MaxUploadSize > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, token.MaxUploadSize)
+		}
+
 		//get the multipart reader for the request.
 		reader, err := r.MultipartReader()
 		if err != nil {
@@ -49,7 +86,7 @@ func (u *UploadServer) uploadHandler(w http.ResponseWriter, r *http.Request) {
 
 		//copy each part to destination.
 		fileName := ""
-		tmpFile, err := os.CreateTemp(u.tmpDir, "multipart-receiver")
+		tmpFile, err := u.storage.NewTemp()
 		if err != nil {
 			log.Printf("%s %s - Error: %v", r.Method, r.URL, err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -57,7 +94,7 @@ func (u *UploadServer) uploadHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		defer tmpFile.Close()
 
-		fileHash := sha1.New()
+		fileHash := u.newHasher()
 
 		for {
 			part, err := reader.NextPart()
@@ -65,34 +102,96 @@ func (u *UploadServer) uploadHandler(w http.ResponseWriter, r *http.Request) {
 				break
 			}
 
-			fileName = strings.ToLower(part.FileName())
+			rawFileName := part.FileName()
 
 			//if part.FileName() is empty, skip this iteration.
-			if fileName == "" {
+			if rawFileName == "" {
 				continue
 			}
 
-			written, err := io.Copy(tmpFile, io.TeeReader(part, fileHash))
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				log.Printf("%s %s - Error: %v", r.Method, r.URL, err)
+			fileName = sanitizeFileName(strings.ToLower(rawFileName))
+			if fileName == "" {
+				http.Error(w, `{"message":"invalid filename"}`, http.StatusBadRequest)
+				log.Printf("%s %s - Error: rejected filename %q", r.Method, r.URL, rawFileName)
+				os.Remove(tmpFile.Name())
+				return
+			}
+
+			if mimeType := part.Header.Get("Content-Type"); token != nil && !token.allowsMimeType(mimeType) {
+				http.Error(w, fmt.Sprintf(`{"message":"mime type %q is not allowed for this token"}`, mimeType), http.StatusForbidden)
+				log.Printf("%s %s - Error: rejected mime type %q for %s", r.Method, r.URL, mimeType, fileName)
+				os.Remove(tmpFile.Name())
+				return
+			}
+			fileName = token.scopedFileName(fileName)
+
+			dest := io.MultiWriter(tmpFile, fileHash)
+
+			var scanPipe *io.PipeWriter
+			var scanResult chan scanOutcome
+			if u.scanner != nil {
+				var scanReader *io.PipeReader
+				scanReader, scanPipe = io.Pipe()
+				dest = io.MultiWriter(dest, scanPipe)
+				scanResult = make(chan scanOutcome, 1)
+				go func() {
+					verdict, err := u.scanner.Scan(scanReader, fileName)
+					// Close the read half even if Scan returned early (e.g.
+					// clamd was unreachable) so a still-running io.Copy into
+					// scanPipe unblocks instead of writing to a reader that
+					// will never come back.
+					scanReader.Close()
+					scanResult <- scanOutcome{verdict, err}
+				}()
+			}
+
+			written, copyErr := io.Copy(dest, part)
+			if scanPipe != nil {
+				scanPipe.Close()
+			}
+			// A copyErr here can simply mean the scanner closed its pipe
+			// early (e.g. it couldn't reach clamd), which fails io.Copy with
+			// io.ErrClosedPipe before the real cause - outcome.err - is ever
+			// read. Don't 500 on that until the scan outcome says whether
+			// this should fail open or closed.
+			if copyErr != nil && scanResult == nil {
+				http.Error(w, copyErr.Error(), http.StatusInternalServerError)
+				log.Printf("%s %s - Error: %v", r.Method, r.URL, copyErr)
 				os.Remove(tmpFile.Name())
 				return
 			}
+
+			if scanResult != nil {
+				outcome := <-scanResult
+				if outcome.err != nil {
+					if !u.scannerFailOpen {
+						http.Error(w, fmt.Sprintf(`{"message":"scanner unavailable: %s"}`, outcome.err), http.StatusBadGateway)
+						log.Printf("%s %s - Error: %v", r.Method, r.URL, outcome.err)
+						os.Remove(tmpFile.Name())
+						return
+					}
+					log.Printf("%s %s - scanner unavailable, failing open: %v", r.Method, r.URL, outcome.err)
+				} else if copyErr != nil {
+					http.Error(w, copyErr.Error(), http.StatusInternalServerError)
+					log.Printf("%s %s - Error: %v", r.Method, r.URL, copyErr)
+					os.Remove(tmpFile.Name())
+					return
+				} else if outcome.verdict.Infected {
+					os.Remove(tmpFile.Name())
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusUnprocessableEntity)
+					fmt.Fprintf(w, `{"message":"upload rejected by virus scanner","signature":%q}`, outcome.verdict.Signature)
+					log.Printf("%s %s - scanner found %s in %s", r.Method, r.URL, outcome.verdict.Signature, fileName)
+					return
+				}
+			}
+
 			log.Printf("%s %s - Written %d bytes to %s", r.Method, r.URL, written, tmpFile.Name())
 		}
 
 		// move to final destination
-		finalDestinationPath := u.generateTargetPath(fileName, hex.EncodeToString(fileHash.Sum(nil)))
-		if finalDestinationPath == "" {
-			err = fmt.Errorf(`{ "message": "'%s' already exists" }`, fileName)
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			log.Printf("%s %s - Error: %v", r.Method, r.URL, err)
-			os.Remove(tmpFile.Name())
-			return
-		}
-
-		err = os.Rename(tmpFile.Name(), finalDestinationPath)
+		contentHash := hex.EncodeToString(fileHash.Sum(nil))
+		status, body, err := u.commitUpload(tmpFile, fileName, contentHash)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			log.Printf("%s %s - Error: %v", r.Method, r.URL, err)
@@ -100,34 +199,82 @@ func (u *UploadServer) uploadHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		log.Printf("%s %s - Created %s", r.Method, r.URL, finalDestinationPath)
+		log.Printf("%s %s - %s", r.Method, r.URL, body)
 
-		w.WriteHeader(http.StatusCreated)
-		w.Write([]byte(`{"ok":"ok"}`))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(body)
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
-func (u *UploadServer) generateTargetPath(fileName, fileHash string) string {
-	finalDestinationPath := path.Clean(fmt.Sprintf("%s/%s", u.targetDir, fileName))
-
+func (u *UploadServer) generateTargetName(fileName, fileHash string) string {
 	// if there is a file with the same name
-	if fileExists(finalDestinationPath) {
-		existingFileHash, err := getFileHash(finalDestinationPath)
+	if u.storage.Exists(fileName) {
+		existingFileHash, err := u.storage.Hash(fileName)
 		// check if they have a matching hash
 		if err == nil && existingFileHash != fileHash {
-			extension := filepath.Ext(fileName)
-			fileNameWithoutExtension := strings.TrimSuffix(fileName, extension)
-			// change filename
-			return path.Clean(fmt.Sprintf("%s/%s_%s%s", u.targetDir, fileNameWithoutExtension, fileHash[0:7], extension))
+			return u.collisionPolicy.Resolve(u.storage, fileName, fileHash)
 		}
 
 		// hashes are the same, do not accept the uploaded file
 		return ""
 	}
 
-	return finalDestinationPath
+	return fileName
+}
+
+// commitUpload finalizes tmp's content as fileName, returning the status
+// code and JSON response body to send back to the client. Under
+// -layout=cas, fileName only supplies the extension of the content-addressed
+// path and the human-readable alias recorded alongside it. commitUpload always takes
+// ownership of tmp: it is either handed to Storage to commit, or removed.
+func (u *UploadServer) commitUpload(tmp *os.File, fileName, contentHash string) (int, []byte, error) {
+	if u.casLayout {
+		casStorage, ok := u.storage.(CASStorage)
+		if !ok {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return 0, nil, fmt.Errorf("-layout=cas is not supported by the configured -storage backend")
+		}
+
+		finalPath, alreadyExisted, err := casStorage.CommitCAS(tmp, u.hashAlgo, contentHash, filepath.Ext(fileName))
+		if err != nil {
+			return 0, nil, err
+		}
+		if aliasStorage, ok := u.storage.(CASAliasStorage); ok {
+			if err := aliasStorage.RecordCASAlias(u.hashAlgo, fileName, finalPath); err != nil {
+				log.Printf("Error recording CAS alias for %s: %v", fileName, err)
+			}
+		}
+
+		body, err := json.Marshal(map[string]string{"hash": contentHash, "algo": u.hashAlgo, "path": finalPath})
+		if err != nil {
+			return 0, nil, err
+		}
+
+		status := http.StatusCreated
+		if alreadyExisted {
+			status = http.StatusOK
+		}
+		return status, body, nil
+	}
+
+	finalName := u.generateTargetName(fileName, contentHash)
+	if finalName == "" {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return http.StatusBadRequest, []byte(fmt.Sprintf(`{"message":"'%s' already exists"}`, fileName)), nil
+	}
+
+	finalPath, err := u.storage.Commit(tmp, finalName, contentHash)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	log.Printf("Created %s", finalPath)
+	return http.StatusCreated, []byte(`{"ok":"ok"}`), nil
 }
 
 func fileExists(path string) bool {
@@ -141,23 +288,6 @@ func fileExists(path string) bool {
 	}
 }
 
-func getFileHash(filePath string) (string, error) {
-	file, err := os.Open(filePath)
-	if err == os.ErrNotExist {
-		return "", err
-	}
-
-	defer file.Close()
-
-	hash := sha1.New()
-
-	if _, err := io.Copy(hash, file); err != nil {
-		return "", err
-	}
-
-	return hex.EncodeToString(hash.Sum(nil)), nil
-}
-
 func main() {
 	userHomeDir, err := os.UserHomeDir()
 	if err != nil {
@@ -166,28 +296,128 @@ func main() {
 
 	tmpDirFlag := flag.String("tmpdir", os.TempDir(), "directory for storing temporary files")
 	targetDirFlag := flag.String("datadir", path.Clean(userHomeDir+"/data"), "directory for storing final files")
-
-	log.Printf("Ensuring tmp and data directories (%s and %s)", *tmpDirFlag, *targetDirFlag)
+	scannerFlag := flag.String("scanner", "", "content scanner to run on uploads before they are stored: clamav, virustotal")
+	scannerAddrFlag := flag.String("scanner-addr", "", "clamd address for -scanner=clamav (host:port or unix:/path/to/socket)")
+	scannerKeyFlag := flag.String("scanner-key", "", "API key for -scanner=virustotal")
+	scannerFailOpenFlag := flag.Bool("scanner-fail-open", false, "accept uploads when the scanner is unavailable instead of rejecting them")
+	uploadTTLFlag := flag.Duration("upload-ttl", 24*time.Hour, "how long an in-progress resumable upload may sit idle before it is purged")
+	onConflictFlag := flag.String("on-conflict", "hash-suffix", "how to handle an uploaded filename that already exists with different content: reject, hash-suffix, overwrite, timestamp-suffix, numeric-suffix")
+	storageFlag := flag.String("storage", "local", "where accepted uploads are stored: local, s3, webdav")
+	s3EndpointFlag := flag.String("s3-endpoint", "", "endpoint for -storage=s3")
+	s3BucketFlag := flag.String("s3-bucket", "", "bucket for -storage=s3")
+	s3PrefixFlag := flag.String("s3-prefix", "", "key prefix for -storage=s3")
+	s3AccessKeyFlag := flag.String("s3-access-key", "", "access key for -storage=s3")
+	s3SecretKeyFlag := flag.String("s3-secret-key", "", "secret key for -storage=s3")
+	s3UseSSLFlag := flag.Bool("s3-use-ssl", true, "use TLS when talking to -s3-endpoint")
+	webdavURLFlag := flag.String("webdav-url", "", "root URL for -storage=webdav")
+	webdavPrefixFlag := flag.String("webdav-prefix", "", "path prefix for -storage=webdav")
+	webdavUserFlag := flag.String("webdav-user", "", "basic auth user for -storage=webdav")
+	webdavPasswordFlag := flag.String("webdav-password", "", "basic auth password for -storage=webdav")
+	hashFlag := flag.String("hash", "sha1", "hash algorithm used to verify and address uploads: sha1, sha256, blake3")
+	layoutFlag := flag.String("layout", "name", "how uploads are laid out in storage: name (keep client filenames), cas (content-addressable)")
+	authConfigFlag := flag.String("auth-config", "", "path to a JSON or YAML file of bearer tokens and their permissions; enables token auth when set")
+	requireAuthFlag := flag.Bool("require-auth", false, "require a valid token even for anonymous GET access to the upload form")
+
+	log.Printf("Ensuring tmp directory (%s)", *tmpDirFlag)
 
 	err = os.MkdirAll(*tmpDirFlag, 0744)
 	if err != nil {
 		log.Fatalf("Could not create tmp dir: %v", err)
 	}
-	err = os.MkdirAll(*targetDirFlag, 0744)
+	if *storageFlag == "" || *storageFlag == "local" {
+		log.Printf("Ensuring data directory (%s)", *targetDirFlag)
+		err = os.MkdirAll(*targetDirFlag, 0744)
+		if err != nil {
+			log.Fatalf("Could not create data dir: %v", err)
+		}
+	}
+
+	newHasher, err := NewHasher(*hashFlag)
 	if err != nil {
-		log.Fatalf("Could not create data dir: %v", err)
+		log.Fatalf("Could not set up hash algorithm: %v", err)
+	}
+
+	var casLayout bool
+	switch *layoutFlag {
+	case "", "name":
+		casLayout = false
+	case "cas":
+		casLayout = true
+	default:
+		log.Fatalf("Unknown -layout %q", *layoutFlag)
+	}
+
+	storage, err := NewStorage(*storageFlag, StorageConfig{
+		TmpDir:         *tmpDirFlag,
+		TargetDir:      *targetDirFlag,
+		HasherFactory:  newHasher,
+		S3Endpoint:     *s3EndpointFlag,
+		S3Bucket:       *s3BucketFlag,
+		S3Prefix:       *s3PrefixFlag,
+		S3AccessKey:    *s3AccessKeyFlag,
+		S3SecretKey:    *s3SecretKeyFlag,
+		S3UseSSL:       *s3UseSSLFlag,
+		WebDAVURL:      *webdavURLFlag,
+		WebDAVPrefix:   *webdavPrefixFlag,
+		WebDAVUser:     *webdavUserFlag,
+		WebDAVPassword: *webdavPasswordFlag,
+	})
+	if err != nil {
+		log.Fatalf("Could not set up storage: %v", err)
+	}
+
+	scanner, err := NewScanner(*scannerFlag, *scannerAddrFlag, *scannerKeyFlag)
+	if err != nil {
+		log.Fatalf("Could not set up scanner: %v", err)
+	}
+
+	collisionPolicy, err := NewCollisionPolicy(*onConflictFlag)
+	if err != nil {
+		log.Fatalf("Could not set up collision policy: %v", err)
+	}
+
+	if casLayout {
+		if _, ok := storage.(CASStorage); !ok {
+			log.Fatalf("-layout=cas is not supported by -storage=%s", *storageFlag)
+		}
+	}
+
+	var authConfig *AuthConfig
+	if *authConfigFlag != "" {
+		authConfig, err = NewAuthConfig(*authConfigFlag)
+		if err != nil {
+			log.Fatalf("Could not load -auth-config: %v", err)
+		}
+		authConfig.watchReload()
 	}
 
 	u := UploadServer{
-		tmpDir:    *tmpDirFlag,
-		targetDir: *targetDirFlag,
+		tmpDir:          *tmpDirFlag,
+		storage:         storage,
+		scanner:         scanner,
+		scannerFailOpen: *scannerFailOpenFlag,
+		resumableTTL:    *uploadTTLFlag,
+		collisionPolicy: collisionPolicy,
+		hashAlgo:        *hashFlag,
+		newHasher:       newHasher,
+		casLayout:       casLayout,
+		auth:            authConfig,
+		requireAuth:     *requireAuthFlag,
 	}
 
+	go u.janitor(10 * time.Minute)
+
 	http.HandleFunc("/upload", u.uploadHandler)
+	http.HandleFunc("/upload/", u.resumableHandler)
 
 	listenAddress := "0.0.0.0:8080"
 
-	http.Handle("/", http.FileServer(http.FS(static)))
+	var rootHandler http.Handler = http.FileServer(http.FS(static))
+	if authConfig != nil && *requireAuthFlag {
+		rootHandler = u.requireAuthMiddleware(rootHandler)
+	}
+	http.Handle("/", rootHandler)
+
 	log.Printf("Starting server. Listening on http://%s", listenAddress)
 	log.Fatal(http.ListenAndServe(listenAddress, nil))
 }
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+// TestGenerateTargetNameRejectsSameHash covers the hash-verification reject
+// path: re-uploading content that already exists under the same name and
+// hash must be rejected rather than duplicated or overwritten.
+func TestGenerateTargetNameRejectsSameHash(t *testing.T) {
+	storage := newFakeStorage("report.pdf")
+	storage.hashes["report.pdf"] = "deadbeef"
+
+	u := &UploadServer{storage: storage, collisionPolicy: hashSuffixCollisionPolicy{}}
+
+	got := u.generateTargetName("report.pdf", "deadbeef")
+	if got != "" {
+		t.Errorf("generateTargetName() = %q, want \"\" (identical content must be rejected)", got)
+	}
+}
+
+func TestGenerateTargetNameNewFile(t *testing.T) {
+	storage := newFakeStorage()
+	u := &UploadServer{storage: storage, collisionPolicy: hashSuffixCollisionPolicy{}}
+
+	got := u.generateTargetName("report.pdf", "deadbeef")
+	if got != "report.pdf" {
+		t.Errorf("generateTargetName() = %q, want \"report.pdf\"", got)
+	}
+}
+
+func TestGenerateTargetNameDefersToCollisionPolicy(t *testing.T) {
+	storage := newFakeStorage("report.pdf")
+	storage.hashes["report.pdf"] = "deadbeef"
+
+	u := &UploadServer{storage: storage, collisionPolicy: rejectCollisionPolicy{}}
+	if got := u.generateTargetName("report.pdf", "different-hash"); got != "" {
+		t.Errorf("generateTargetName() with reject policy = %q, want \"\"", got)
+	}
+
+	u.collisionPolicy = hashSuffixCollisionPolicy{}
+	if got := u.generateTargetName("report.pdf", "different-hash"); got == "" || got == "report.pdf" {
+		t.Errorf("generateTargetName() with hash-suffix policy = %q, want a renamed file", got)
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resumableChunkSize is reported to clients from /upload/init as the chunk
+// size they should use for subsequent PATCH requests.
+const resumableChunkSize = 8 * 1024 * 1024
+
+// uploadState is the JSON sidecar persisted alongside each in-progress
+// resumable upload so it survives a server restart.
+type uploadState struct {
+	ID               string    `json:"id"`
+	OriginalFilename string    `json:"original_filename"`
+	ExpectedHash     string    `json:"expected_hash,omitempty"`
+	Size             int64     `json:"size"`
+	Offset           int64     `json:"offset"`
+	CreatedAt        time.Time `json:"created_at"`
+	LastActivityAt   time.Time `json:"last_activity_at"`
+	Token            string    `json:"token,omitempty"`
+}
+
+type uploadInitRequest struct {
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	SHA1     string `json:"sha1,omitempty"`
+}
+
+type uploadInitResponse struct {
+	ID        string `json:"id"`
+	ChunkSize int64  `json:"chunkSize"`
+}
+
+// resumableHandler dispatches the /upload/init, PATCH /upload/{id} and
+// HEAD /upload/{id} endpoints that make up the resumable upload mode.
+func (u *UploadServer) resumableHandler(w http.ResponseWriter, r *http.Request) {
+	token, ok := u.authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if r.URL.Path == "/upload/init" && r.Method == http.MethodPost {
+		u.uploadInitHandler(w, r, token)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/upload/")
+	if id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPatch:
+		u.uploadChunkHandler(w, r, id, token)
+	case http.MethodHead:
+		u.uploadStatusHandler(w, r, id)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (u *UploadServer) uploadInitHandler(w http.ResponseWriter, r *http.Request, token *tokenState) {
+	var req uploadInitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf(`{"message":"invalid request body: %s"}`, err), http.StatusBadRequest)
+		return
+	}
+	fileName := sanitizeFileName(strings.ToLower(req.Filename))
+	if fileName == "" {
+		http.Error(w, `{"message":"invalid filename"}`, http.StatusBadRequest)
+		return
+	}
+	if token != nil && token.MaxUploadSize > 0 && req.Size > token.MaxUploadSize {
+		http.Error(w, fmt.Sprintf(`{"message":"upload of %d bytes exceeds this token's limit of %d bytes"}`, req.Size, token.MaxUploadSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	fileName = token.scopedFileName(fileName)
+
+	id, err := generateUploadID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("%s %s - Error: %v", r.Method, r.URL, err)
+		return
+	}
+
+	now := time.Now()
+	state := &uploadState{
+		ID:               id,
+		OriginalFilename: fileName,
+		ExpectedHash:     strings.ToLower(req.SHA1),
+		Size:             req.Size,
+		CreatedAt:        now,
+		LastActivityAt:   now,
+		Token:            tokenValue(token),
+	}
+
+	partFile, err := os.Create(u.resumablePartPath(id))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("%s %s - Error: %v", r.Method, r.URL, err)
+		return
+	}
+	partFile.Close()
+
+	if err := u.saveUploadState(state); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("%s %s - Error: %v", r.Method, r.URL, err)
+		return
+	}
+
+	log.Printf("%s %s - Initialized upload %s for %s", r.Method, r.URL, id, state.OriginalFilename)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(uploadInitResponse{ID: id, ChunkSize: resumableChunkSize})
+}
+
+func (u *UploadServer) uploadChunkHandler(w http.ResponseWriter, r *http.Request, id string, token *tokenState) {
+	unlock := u.lockUpload(id)
+	defer unlock()
+
+	state, err := u.loadUploadState(id)
+	if err != nil {
+		http.Error(w, `{"message":"unknown upload id"}`, http.StatusNotFound)
+		return
+	}
+	if tokenValue(token) != state.Token {
+		http.Error(w, `{"message":"token does not match the one this upload was started with"}`, http.StatusForbidden)
+		return
+	}
+
+	start, end, total, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"message":"invalid Content-Range: %s"}`, err), http.StatusBadRequest)
+		return
+	}
+	if start != state.Offset {
+		http.Error(w, fmt.Sprintf(`{"message":"expected offset %d, got %d"}`, state.Offset, start), http.StatusConflict)
+		return
+	}
+	if token != nil && token.MaxUploadSize > 0 && total > token.MaxUploadSize {
+		http.Error(w, fmt.Sprintf(`{"message":"upload of %d bytes exceeds this token's limit of %d bytes"}`, total, token.MaxUploadSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	partFile, err := os.OpenFile(u.resumablePartPath(id), os.O_WRONLY, 0644)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("%s %s - Error: %v", r.Method, r.URL, err)
+		return
+	}
+	defer partFile.Close()
+
+	if _, err := partFile.Seek(start, io.SeekStart); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("%s %s - Error: %v", r.Method, r.URL, err)
+		return
+	}
+
+	written, err := io.Copy(partFile, io.LimitReader(r.Body, end-start+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("%s %s - Error: %v", r.Method, r.URL, err)
+		return
+	}
+	log.Printf("%s %s - Written %d bytes to upload %s at offset %d", r.Method, r.URL, written, id, start)
+
+	state.Offset += written
+	state.LastActivityAt = time.Now()
+	if total > 0 {
+		state.Size = total
+	}
+	if sha1Header := r.Header.Get("X-Content-SHA1"); sha1Header != "" {
+		state.ExpectedHash = strings.ToLower(sha1Header)
+	}
+
+	isFinal := state.Size > 0 && state.Offset >= state.Size
+	if !isFinal {
+		if err := u.saveUploadState(state); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Printf("%s %s - Error: %v", r.Method, r.URL, err)
+			return
+		}
+		w.Header().Set("X-Upload-Offset", strconv.FormatInt(state.Offset, 10))
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	// X-Content-SHA1 is always a SHA1 of the assembled content, independent
+	// of -hash, so verify it with a dedicated sha1.New hasher rather than
+	// u.newHasher (which may be configured for sha256/blake3 and would
+	// never match).
+	if state.ExpectedHash != "" {
+		actualSHA1, err := hashFile(u.resumablePartPath(id), sha1.New)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Printf("%s %s - Error: %v", r.Method, r.URL, err)
+			return
+		}
+		if state.ExpectedHash != actualSHA1 {
+			u.abortUpload(id)
+			http.Error(w, fmt.Sprintf(`{"message":"hash mismatch: expected %s, got %s"}`, state.ExpectedHash, actualSHA1), http.StatusConflict)
+			log.Printf("%s %s - Upload %s failed hash verification", r.Method, r.URL, id)
+			return
+		}
+	}
+
+	if u.scanner != nil {
+		scanFile, err := os.Open(u.resumablePartPath(id))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Printf("%s %s - Error: %v", r.Method, r.URL, err)
+			return
+		}
+		verdict, err := u.scanner.Scan(scanFile, state.OriginalFilename)
+		scanFile.Close()
+		if err != nil {
+			if !u.scannerFailOpen {
+				http.Error(w, fmt.Sprintf(`{"message":"scanner unavailable: %s"}`, err), http.StatusBadGateway)
+				log.Printf("%s %s - Error: %v", r.Method, r.URL, err)
+				return
+			}
+			log.Printf("%s %s - scanner unavailable, failing open: %v", r.Method, r.URL, err)
+		} else if verdict.Infected {
+			u.abortUpload(id)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			fmt.Fprintf(w, `{"message":"upload rejected by virus scanner","signature":%q}`, verdict.Signature)
+			log.Printf("%s %s - scanner found %s in upload %s", r.Method, r.URL, verdict.Signature, id)
+			return
+		}
+	}
+
+	actualHash, err := hashFile(u.resumablePartPath(id), u.newHasher)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("%s %s - Error: %v", r.Method, r.URL, err)
+		return
+	}
+
+	finalFile, err := os.Open(u.resumablePartPath(id))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("%s %s - Error: %v", r.Method, r.URL, err)
+		return
+	}
+
+	status, body, err := u.commitUpload(finalFile, state.OriginalFilename, actualHash)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("%s %s - Error: %v", r.Method, r.URL, err)
+		return
+	}
+	os.Remove(u.resumableStatePath(id))
+
+	log.Printf("%s %s - Completed upload %s -> %s", r.Method, r.URL, id, body)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func (u *UploadServer) uploadStatusHandler(w http.ResponseWriter, r *http.Request, id string) {
+	state, err := u.loadUploadState(id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("X-Upload-Offset", strconv.FormatInt(state.Offset, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (u *UploadServer) abortUpload(id string) {
+	os.Remove(u.resumablePartPath(id))
+	os.Remove(u.resumableStatePath(id))
+}
+
+func (u *UploadServer) resumableStatePath(id string) string {
+	return filepath.Join(u.tmpDir, "resumable-"+id+".json")
+}
+
+func (u *UploadServer) resumablePartPath(id string) string {
+	return filepath.Join(u.tmpDir, "resumable-"+id+".part")
+}
+
+func (u *UploadServer) saveUploadState(state *uploadState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(u.resumableStatePath(state.ID), data, 0644)
+}
+
+func (u *UploadServer) loadUploadState(id string) (*uploadState, error) {
+	data, err := os.ReadFile(u.resumableStatePath(id))
+	if err != nil {
+		return nil, err
+	}
+	var state uploadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// lockUpload serializes chunk requests for a single upload ID and returns
+// the function to call to release the lock.
+func (u *UploadServer) lockUpload(id string) func() {
+	value, _ := u.resumableLocks.LoadOrStore(id, &sync.Mutex{})
+	mu := value.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+func generateUploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func parseContentRange(header string) (start, end, total int64, err error) {
+	if !strings.HasPrefix(header, "bytes ") {
+		return 0, 0, 0, fmt.Errorf("missing \"bytes\" unit")
+	}
+
+	spec := strings.TrimPrefix(header, "bytes ")
+	rangeAndSize := strings.SplitN(spec, "/", 2)
+	if len(rangeAndSize) != 2 {
+		return 0, 0, 0, fmt.Errorf("missing total size")
+	}
+
+	bounds := strings.SplitN(rangeAndSize[0], "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, 0, fmt.Errorf("malformed range")
+	}
+
+	start, err = strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	end, err = strconv.ParseInt(bounds[1], 10, 64)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	if rangeAndSize[1] == "*" {
+		return start, end, 0, nil
+	}
+	total, err = strconv.ParseInt(rangeAndSize[1], 10, 64)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return start, end, total, nil
+}
+
+// janitor periodically purges resumable uploads that have been idle for
+// longer than resumableTTL, freeing their tmpDir state and part files.
+func (u *UploadServer) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		u.purgeStaleUploads()
+	}
+}
+
+func (u *UploadServer) purgeStaleUploads() {
+	entries, err := os.ReadDir(u.tmpDir)
+	if err != nil {
+		log.Printf("janitor - Error reading tmp dir: %v", err)
+		return
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, "resumable-") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		id := strings.TrimSuffix(strings.TrimPrefix(name, "resumable-"), ".json")
+
+		// Take the same per-ID lock uploadChunkHandler uses, so we never
+		// purge an upload out from under a chunk that is actively being
+		// written, and re-read the state once locked in case a chunk
+		// landed between the directory listing and now.
+		unlock := u.lockUpload(id)
+		state, err := u.loadUploadState(id)
+		if err != nil {
+			unlock()
+			continue
+		}
+
+		lastActivity := state.LastActivityAt
+		if lastActivity.IsZero() {
+			lastActivity = state.CreatedAt
+		}
+		if time.Since(lastActivity) > u.resumableTTL {
+			log.Printf("janitor - purging stale upload %s (%s)", id, state.OriginalFilename)
+			u.abortUpload(id)
+		}
+		unlock()
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestParseContentRange(t *testing.T) {
+	cases := []struct {
+		name      string
+		header    string
+		wantStart int64
+		wantEnd   int64
+		wantTotal int64
+		wantErr   bool
+	}{
+		{"full range", "bytes 0-1023/2048", 0, 1023, 2048, false},
+		{"middle chunk", "bytes 1024-2047/4096", 1024, 2047, 4096, false},
+		{"unknown total", "bytes 0-1023/*", 0, 1023, 0, false},
+		{"missing unit", "0-1023/2048", 0, 0, 0, true},
+		{"missing total", "bytes 0-1023", 0, 0, 0, true},
+		{"malformed range", "bytes 0/2048", 0, 0, 0, true},
+		{"non-numeric start", "bytes a-1023/2048", 0, 0, 0, true},
+		{"non-numeric total", "bytes 0-1023/abc", 0, 0, 0, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			start, end, total, err := parseContentRange(c.header)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("parseContentRange(%q) = nil error, want error", c.header)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseContentRange(%q) returned unexpected error: %v", c.header, err)
+			}
+			if start != c.wantStart || end != c.wantEnd || total != c.wantTotal {
+				t.Errorf("parseContentRange(%q) = (%d, %d, %d), want (%d, %d, %d)",
+					c.header, start, end, total, c.wantStart, c.wantEnd, c.wantTotal)
+			}
+		})
+	}
+}
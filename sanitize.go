@@ -0,0 +1,50 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// windowsReservedNames are device names that cannot be used as a filename on
+// Windows, regardless of extension.
+var windowsReservedNames = map[string]bool{
+	"con": true, "prn": true, "aux": true, "nul": true,
+	"com1": true, "com2": true, "com3": true, "com4": true, "com5": true,
+	"com6": true, "com7": true, "com8": true, "com9": true,
+	"lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true, "lpt5": true,
+	"lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+}
+
+// sanitizeFileName strips path separators, control/format characters and
+// other metadata a client could smuggle in part.FileName() to escape
+// targetDir or collide with a reserved name. It returns "" if nothing usable
+// remains, which callers must treat as a rejected upload.
+func sanitizeFileName(name string) string {
+	name = filepath.Base(filepath.Clean(strings.ReplaceAll(name, "\\", "/")))
+	if name == "." || name == ".." || name == "/" {
+		return ""
+	}
+
+	var b strings.Builder
+	for _, r := range name {
+		// drop control characters and invisible Unicode format characters
+		// (zero-width space, RTL/LTR marks, BOM, ...) used to spoof names.
+		if unicode.IsControl(r) || unicode.In(r, unicode.Cf) {
+			continue
+		}
+		b.WriteRune(r)
+	}
+	name = strings.Trim(b.String(), " .")
+	if name == "" {
+		return ""
+	}
+
+	extension := filepath.Ext(name)
+	base := strings.TrimSuffix(name, extension)
+	if windowsReservedNames[strings.ToLower(base)] {
+		return ""
+	}
+
+	return name
+}
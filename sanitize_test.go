@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestSanitizeFileName(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain name", "report.pdf", "report.pdf"},
+		{"path traversal", "../../etc/passwd", "passwd"},
+		{"absolute path", "/etc/passwd", "passwd"},
+		{"windows separators", `..\..\windows\system32\evil.dll`, "evil.dll"},
+		{"bare dot", ".", ""},
+		{"bare dotdot", "..", ""},
+		{"control characters", "evil\x00name.txt", "evilname.txt"},
+		{"zero-width space", "report​.pdf", "report.pdf"},
+		{"trailing dot and space", "report.pdf. ", "report.pdf"},
+		{"windows reserved device name", "CON", ""},
+		{"windows reserved device name with extension", "con.txt", ""},
+		{"reserved name is case-insensitive", "Com1.txt", ""},
+		{"reserved-looking but not reserved", "console.txt", "console.txt"},
+		{"only separators", "///", ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := sanitizeFileName(c.in); got != c.want {
+				t.Errorf("sanitizeFileName(%q) = %q, want %q", c.in, got, c.want)
+			}
+		})
+	}
+}
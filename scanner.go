@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ScanVerdict describes the outcome of a content scan.
+type ScanVerdict struct {
+	Infected  bool
+	Signature string
+}
+
+// Scanner inspects the content read from r and reports whether it is malicious.
+type Scanner interface {
+	Scan(r io.Reader, fileName string) (*ScanVerdict, error)
+}
+
+// NewScanner builds the Scanner selected by -scanner, or nil if scanning is disabled.
+func NewScanner(kind, addr, key string) (Scanner, error) {
+	switch kind {
+	case "":
+		return nil, nil
+	case "clamav":
+		if addr == "" {
+			return nil, fmt.Errorf("-scanner-addr is required for the clamav scanner")
+		}
+		return &ClamAVScanner{addr: addr}, nil
+	case "virustotal":
+		if key == "" {
+			return nil, fmt.Errorf("-scanner-key is required for the virustotal scanner")
+		}
+		return &VirusTotalScanner{apiKey: key}, nil
+	default:
+		return nil, fmt.Errorf("unknown scanner %q", kind)
+	}
+}
+
+// ClamAVScanner talks to a clamd daemon using the INSTREAM protocol.
+type ClamAVScanner struct {
+	addr string // "host:port" for TCP, or "unix:/path/to/socket"
+}
+
+func (c *ClamAVScanner) dial() (net.Conn, error) {
+	if strings.HasPrefix(c.addr, "unix:") {
+		return net.Dial("unix", strings.TrimPrefix(c.addr, "unix:"))
+	}
+	return net.Dial("tcp", c.addr)
+}
+
+func (c *ClamAVScanner) Scan(r io.Reader, fileName string) (*ScanVerdict, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, fmt.Errorf("clamav: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return nil, fmt.Errorf("clamav: %w", err)
+	}
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			size := make([]byte, 4)
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, werr := conn.Write(size); werr != nil {
+				return nil, fmt.Errorf("clamav: %w", werr)
+			}
+			if _, werr := conn.Write(buf[:n]); werr != nil {
+				return nil, fmt.Errorf("clamav: %w", werr)
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return nil, fmt.Errorf("clamav: %w", rerr)
+		}
+	}
+
+	// a zero-length chunk terminates the stream
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return nil, fmt.Errorf("clamav: %w", err)
+	}
+
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		return nil, fmt.Errorf("clamav: %w", err)
+	}
+
+	return parseClamAVReply(reply)
+}
+
+func parseClamAVReply(reply []byte) (*ScanVerdict, error) {
+	line := strings.TrimRight(string(reply), "\x00\r\n")
+	switch {
+	case strings.HasSuffix(line, "OK"):
+		return &ScanVerdict{Infected: false}, nil
+	case strings.Contains(line, "FOUND"):
+		line = strings.TrimSuffix(line, " FOUND")
+		if idx := strings.LastIndex(line, ": "); idx != -1 {
+			return &ScanVerdict{Infected: true, Signature: line[idx+2:]}, nil
+		}
+		return &ScanVerdict{Infected: true, Signature: "unknown"}, nil
+	case strings.Contains(line, "ERROR"):
+		return nil, fmt.Errorf("clamav: %s", line)
+	default:
+		return nil, fmt.Errorf("clamav: unexpected reply %q", line)
+	}
+}
+
+// virusTotalReportPollInterval and virusTotalReportTimeout bound how long
+// Scan waits for VirusTotal to finish analyzing a submitted file before
+// giving up and reporting the scanner as unavailable.
+const (
+	virusTotalReportPollInterval = 3 * time.Second
+	virusTotalReportTimeout      = 60 * time.Second
+)
+
+// VirusTotalScanner submits file content to the VirusTotal public API for
+// scanning, then polls for the verdict before Scan returns.
+type VirusTotalScanner struct {
+	apiKey string
+}
+
+func (v *VirusTotalScanner) Scan(r io.Reader, fileName string) (*ScanVerdict, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	scanID, err := v.submit(client, r, fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(virusTotalReportTimeout)
+	for {
+		verdict, pending, err := v.report(client, scanID)
+		if err != nil {
+			return nil, err
+		}
+		if !pending {
+			return verdict, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("virustotal: analysis of %s did not complete within %s", scanID, virusTotalReportTimeout)
+		}
+		time.Sleep(virusTotalReportPollInterval)
+	}
+}
+
+// submit uploads the content to /file/scan and returns the scan_id to poll
+// for a verdict.
+func (v *VirusTotalScanner) submit(client *http.Client, r io.Reader, fileName string) (string, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	if err := writer.WriteField("apikey", v.apiKey); err != nil {
+		return "", fmt.Errorf("virustotal: %w", err)
+	}
+	part, err := writer.CreateFormFile("file", fileName)
+	if err != nil {
+		return "", fmt.Errorf("virustotal: %w", err)
+	}
+	if _, err := io.Copy(part, r); err != nil {
+		return "", fmt.Errorf("virustotal: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return "", fmt.Errorf("virustotal: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "https://www.virustotal.com/vtapi/v2/file/scan", body)
+	if err != nil {
+		return "", fmt.Errorf("virustotal: %w", err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("virustotal: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("virustotal: unexpected status %s", resp.Status)
+	}
+
+	var result struct {
+		ResponseCode int    `json:"response_code"`
+		ScanID       string `json:"scan_id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("virustotal: %w", err)
+	}
+
+	// VirusTotal queues scans asynchronously, so a successful submission only
+	// tells us the file was accepted for scanning, not the verdict itself.
+	if result.ResponseCode != 1 {
+		return "", fmt.Errorf("virustotal: scan was not queued (response_code %d)", result.ResponseCode)
+	}
+
+	return result.ScanID, nil
+}
+
+// report polls /file/report for scanID's verdict. pending is true while
+// VirusTotal is still analyzing the file.
+func (v *VirusTotalScanner) report(client *http.Client, scanID string) (verdict *ScanVerdict, pending bool, err error) {
+	req, err := http.NewRequest(http.MethodGet, "https://www.virustotal.com/vtapi/v2/file/report", nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("virustotal: %w", err)
+	}
+	q := req.URL.Query()
+	q.Set("apikey", v.apiKey)
+	q.Set("resource", scanID)
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, false, fmt.Errorf("virustotal: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("virustotal: unexpected status %s", resp.Status)
+	}
+
+	var result struct {
+		ResponseCode int                    `json:"response_code"`
+		Positives    int                    `json:"positives"`
+		Scans        map[string]interface{} `json:"scans"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, false, fmt.Errorf("virustotal: %w", err)
+	}
+
+	// response_code 0 (or -2, "still queued") means the report isn't ready yet.
+	if result.ResponseCode != 1 {
+		return nil, true, nil
+	}
+
+	if result.Positives > 0 {
+		return &ScanVerdict{Infected: true, Signature: fmt.Sprintf("%d/%d engines", result.Positives, len(result.Scans))}, false, nil
+	}
+	return &ScanVerdict{Infected: false}, false, nil
+}
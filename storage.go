@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+)
+
+// Storage abstracts where an accepted upload's content ends up living, and
+// how existing content is detected, so that -storage can target local disk,
+// an S3-compatible object store, or WebDAV without touching uploadHandler.
+type Storage interface {
+	// NewTemp stages incoming content on local disk before it is known to
+	// be accepted.
+	NewTemp() (*os.File, error)
+
+	// Commit promotes the content staged at tmp to finalName and returns
+	// the location (path, key or URL) it ends up stored under. Commit
+	// always takes ownership of tmp, closing it.
+	Commit(tmp *os.File, finalName, hash string) (string, error)
+
+	// Exists reports whether finalName is already stored.
+	Exists(finalName string) bool
+
+	// Hash returns the hash of the content already stored under finalName.
+	Hash(finalName string) (string, error)
+}
+
+// CASStorage is implemented by Storage backends that can write a
+// content-addressable layout directly, for -layout=cas.
+type CASStorage interface {
+	// CommitCAS promotes the content staged at tmp to
+	// "<algo>/ab/cd/<hash><ext>", returning the resulting path and whether
+	// that path already existed (meaning the content was already stored).
+	CommitCAS(tmp *os.File, algo, hash, ext string) (casPath string, alreadyExisted bool, err error)
+}
+
+// CASAliasStorage is implemented by Storage backends that can record a
+// human-readable filename alongside a CAS path, for -layout=cas.
+type CASAliasStorage interface {
+	RecordCASAlias(algo, originalName, casPath string) error
+}
+
+// StorageConfig carries every backend-specific flag value needed by
+// NewStorage, regardless of which -storage was selected.
+type StorageConfig struct {
+	TmpDir        string
+	TargetDir     string
+	HasherFactory func() hash.Hash
+
+	S3Endpoint  string
+	S3Bucket    string
+	S3Prefix    string
+	S3AccessKey string
+	S3SecretKey string
+	S3UseSSL    bool
+
+	WebDAVURL      string
+	WebDAVPrefix   string
+	WebDAVUser     string
+	WebDAVPassword string
+}
+
+// NewStorage builds the Storage backend selected by -storage.
+func NewStorage(kind string, cfg StorageConfig) (Storage, error) {
+	switch kind {
+	case "", "local":
+		return NewLocalStorage(cfg.TmpDir, cfg.TargetDir, cfg.HasherFactory), nil
+	case "s3":
+		if cfg.S3Bucket == "" {
+			return nil, fmt.Errorf("-s3-bucket is required for -storage=s3")
+		}
+		return NewS3Storage(cfg.TmpDir, cfg.S3Endpoint, cfg.S3Bucket, cfg.S3Prefix, cfg.S3AccessKey, cfg.S3SecretKey, cfg.S3UseSSL)
+	case "webdav":
+		if cfg.WebDAVURL == "" {
+			return nil, fmt.Errorf("-webdav-url is required for -storage=webdav")
+		}
+		return NewWebDAVStorage(cfg.TmpDir, cfg.WebDAVURL, cfg.WebDAVPrefix, cfg.WebDAVUser, cfg.WebDAVPassword), nil
+	default:
+		return nil, fmt.Errorf("unknown -storage backend %q", kind)
+	}
+}
+
+// LocalStorage stores committed uploads directly on the local filesystem,
+// which was the server's only behavior before -storage existed.
+type LocalStorage struct {
+	tmpDir        string
+	targetDir     string
+	hasherFactory func() hash.Hash
+
+	casIndexMu sync.Mutex
+}
+
+func NewLocalStorage(tmpDir, targetDir string, hasherFactory func() hash.Hash) *LocalStorage {
+	return &LocalStorage{tmpDir: tmpDir, targetDir: targetDir, hasherFactory: hasherFactory}
+}
+
+func (s *LocalStorage) NewTemp() (*os.File, error) {
+	return os.CreateTemp(s.tmpDir, "multipart-receiver")
+}
+
+func (s *LocalStorage) finalPath(finalName string) string {
+	return path.Clean(fmt.Sprintf("%s/%s", s.targetDir, finalName))
+}
+
+func (s *LocalStorage) Commit(tmp *os.File, finalName, hash string) (string, error) {
+	tmpPath := tmp.Name()
+	tmp.Close()
+
+	finalPath := s.finalPath(finalName)
+	if err := os.MkdirAll(filepath.Dir(finalPath), 0744); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpPath, finalPath); err != nil {
+		return "", err
+	}
+	return finalPath, nil
+}
+
+func (s *LocalStorage) Exists(finalName string) bool {
+	return fileExists(s.finalPath(finalName))
+}
+
+func (s *LocalStorage) Hash(finalName string) (string, error) {
+	return hashFile(s.finalPath(finalName), s.hasherFactory)
+}
+
+// casPath returns "<targetDir>/<algo>/<hash[0:2]>/<hash[2:4]>/<hash><ext>".
+func (s *LocalStorage) casPath(algo, hash, ext string) string {
+	return path.Clean(fmt.Sprintf("%s/%s/%s/%s/%s%s", s.targetDir, algo, hash[0:2], hash[2:4], hash, ext))
+}
+
+func (s *LocalStorage) CommitCAS(tmp *os.File, algo, hash, ext string) (string, bool, error) {
+	tmpPath := tmp.Name()
+	tmp.Close()
+
+	finalPath := s.casPath(algo, hash, ext)
+	if fileExists(finalPath) {
+		os.Remove(tmpPath)
+		return finalPath, true, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(finalPath), 0744); err != nil {
+		return "", false, err
+	}
+	if err := os.Rename(tmpPath, finalPath); err != nil {
+		return "", false, err
+	}
+	return finalPath, false, nil
+}
+
+func (s *LocalStorage) RecordCASAlias(algo, originalName, casPath string) error {
+	s.casIndexMu.Lock()
+	defer s.casIndexMu.Unlock()
+
+	indexPath := path.Clean(fmt.Sprintf("%s/%s/index.json", s.targetDir, algo))
+
+	index := map[string]string{}
+	if data, err := os.ReadFile(indexPath); err == nil {
+		json.Unmarshal(data, &index)
+	}
+	index[originalName] = casPath
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(indexPath, data, 0644)
+}
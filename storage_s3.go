@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3HashMetadataKey is the response header the stored content hash (computed
+// with the -hash algorithm, sha1 by default) comes back under.
+// ObjectInfo.UserMetadata only round-trips this on MinIO servers, so
+// we read it from ObjectInfo.Metadata (the raw response headers, populated
+// by every S3-compatible backend) instead.
+const s3HashMetadataKey = "X-Amz-Meta-Sha1"
+
+// S3Storage stores committed uploads in an S3-compatible object store,
+// staging content on local disk (tmpDir) until it is accepted. Dedup is done
+// via a HEAD request comparing the x-amz-meta-sha1 object metadata instead
+// of downloading the object.
+type S3Storage struct {
+	client *minio.Client
+	bucket string
+	prefix string
+	tmpDir string
+}
+
+func NewS3Storage(tmpDir, endpoint, bucket, prefix, accessKey, secretKey string, useSSL bool) (*S3Storage, error) {
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure: useSSL,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("s3 storage: %w", err)
+	}
+	return &S3Storage{client: client, bucket: bucket, prefix: prefix, tmpDir: tmpDir}, nil
+}
+
+func (s *S3Storage) NewTemp() (*os.File, error) {
+	return os.CreateTemp(s.tmpDir, "multipart-receiver")
+}
+
+func (s *S3Storage) key(finalName string) string {
+	if s.prefix == "" {
+		return finalName
+	}
+	return s.prefix + "/" + finalName
+}
+
+func (s *S3Storage) Commit(tmp *os.File, finalName, hash string) (string, error) {
+	tmpPath := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpPath)
+
+	key := s.key(finalName)
+	_, err := s.client.FPutObject(context.Background(), s.bucket, key, tmpPath, minio.PutObjectOptions{
+		UserMetadata: map[string]string{"sha1": hash},
+	})
+	if err != nil {
+		return "", fmt.Errorf("s3 storage: %w", err)
+	}
+
+	return fmt.Sprintf("s3://%s/%s", s.bucket, key), nil
+}
+
+func (s *S3Storage) Exists(finalName string) bool {
+	_, err := s.client.StatObject(context.Background(), s.bucket, s.key(finalName), minio.StatObjectOptions{})
+	return err == nil
+}
+
+func (s *S3Storage) Hash(finalName string) (string, error) {
+	key := s.key(finalName)
+	info, err := s.client.StatObject(context.Background(), s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return "", fmt.Errorf("s3 storage: %w", err)
+	}
+
+	hash := info.Metadata.Get(s3HashMetadataKey)
+	if hash == "" {
+		return "", fmt.Errorf("s3 storage: object %s has no sha1 metadata", key)
+	}
+	return hash, nil
+}